@@ -0,0 +1,147 @@
+// Command prowjob-generator renders the presubmit/postsubmit YAML consumed by prow/config from
+// the compact per-repo specs under --spec-dir. Run with --check in CI to verify the checked-in
+// job config is up to date, or with --write to regenerate it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/prowjobgen"
+)
+
+type options struct {
+	specDir       string
+	templatesDir  string
+	prowConfigDir string
+	outputDir     string
+	check         bool
+	write         bool
+}
+
+func (o *options) validate() error {
+	if o.specDir == "" {
+		return fmt.Errorf("--spec-dir is required")
+	}
+	if o.templatesDir == "" {
+		return fmt.Errorf("--templates-dir is required")
+	}
+	if o.prowConfigDir == "" {
+		return fmt.Errorf("--prow-config-dir is required")
+	}
+	if o.outputDir == "" {
+		return fmt.Errorf("--output-dir is required")
+	}
+	if o.check == o.write {
+		return fmt.Errorf("exactly one of --check or --write must be set")
+	}
+	return nil
+}
+
+func gatherOptions() options {
+	o := options{}
+	flag.StringVar(&o.specDir, "spec-dir", "", "Directory of per-repo RepoSpec YAML files")
+	flag.StringVar(&o.templatesDir, "templates-dir", "", "Directory of job text/template files")
+	flag.StringVar(&o.prowConfigDir, "prow-config-dir", "", "Path to the prow config.yaml used to load the checked-in job config for comparison")
+	flag.StringVar(&o.outputDir, "output-dir", "", "Directory to write generated job config into, one file per org/repo")
+	flag.BoolVar(&o.check, "check", false, "Fail if the generated job config does not match what's on disk, without writing anything")
+	flag.BoolVar(&o.write, "write", false, "Write the generated job config to --output-dir")
+	flag.Parse()
+	return o
+}
+
+func main() {
+	o := gatherOptions()
+	if err := o.validate(); err != nil {
+		logrus.WithError(err).Fatal("invalid options")
+	}
+
+	gen, err := prowjobgen.NewGenerator(o.templatesDir)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to load templates")
+	}
+
+	// Load the checked-in job config through the real prow/config loader first, so a config
+	// that doesn't even parse fails loudly here instead of silently passing --check below. The
+	// per-repo diff itself re-parses the specific output file with ParseJobConfig rather than
+	// using this loaded config, because the loader's defaulting (compiled Brancher regexes,
+	// default cluster/decoration settings) would make every freshly generated job - which never
+	// goes through that defaulting - look different from its already-defaulted, identical twin.
+	if _, err := config.Load(o.prowConfigDir, o.outputDir); err != nil {
+		logrus.WithError(err).Fatal("failed to load existing job config")
+	}
+
+	specFiles, err := filepath.Glob(filepath.Join(o.specDir, "*.yaml"))
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to glob spec files")
+	}
+
+	var outOfDate []string
+	for _, specFile := range specFiles {
+		raw, err := ioutil.ReadFile(specFile)
+		if err != nil {
+			logrus.WithError(err).WithField("file", specFile).Fatal("failed to read spec")
+		}
+
+		var spec prowjobgen.RepoSpec
+		if err := yaml.Unmarshal(raw, &spec); err != nil {
+			logrus.WithError(err).WithField("file", specFile).Fatal("failed to unmarshal spec")
+		}
+
+		presubmits, postsubmits, err := gen.Generate(spec)
+		if err != nil {
+			logrus.WithError(err).WithField("file", specFile).Fatal("failed to generate jobs")
+		}
+
+		outPath := filepath.Join(o.outputDir, spec.Org, spec.Repo+".yaml")
+		existingRaw, err := ioutil.ReadFile(outPath)
+		if err != nil && !os.IsNotExist(err) {
+			logrus.WithError(err).WithField("file", outPath).Fatal("failed to read existing job config")
+		}
+		existingPre, existingPost, err := prowjobgen.ParseJobConfig(existingRaw)
+		if err != nil {
+			logrus.WithError(err).WithField("file", outPath).Fatal("failed to parse existing job config")
+		}
+
+		key := spec.Org + "/" + spec.Repo
+		diff, equal := prowjobgen.DiffJobs(presubmits, existingPre[key], postsubmits, existingPost[key])
+		if equal {
+			continue
+		}
+
+		if o.check {
+			fmt.Fprintf(os.Stderr, "%s is out of date:\n%s\n", outPath, diff)
+			outOfDate = append(outOfDate, outPath)
+			continue
+		}
+
+		// Known gap: this always rewrites outPath from scratch via Marshal rather than merging
+		// into the existing file, so any hand-added comments or a manually chosen key/job order
+		// in the checked-in YAML are lost on --write. A byte-preserving merge would need to walk
+		// the existing file's YAML node tree (e.g. with a library like yaml.v3) and patch only the
+		// jobs DiffJobs found changed; that's more machinery than this generator needs today, so
+		// for now --write is all-or-nothing and callers that hand-edit generated files should
+		// expect --write to clobber those edits.
+		generated, err := prowjobgen.Marshal(spec.Org, spec.Repo, presubmits, postsubmits)
+		if err != nil {
+			logrus.WithError(err).WithField("file", specFile).Fatal("failed to marshal generated jobs")
+		}
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			logrus.WithError(err).WithField("file", outPath).Fatal("failed to create output directory")
+		}
+		if err := ioutil.WriteFile(outPath, generated, 0644); err != nil {
+			logrus.WithError(err).WithField("file", outPath).Fatal("failed to write generated job config")
+		}
+	}
+
+	if len(outOfDate) > 0 {
+		logrus.Fatalf("%d generated job file(s) out of date; run with --write to regenerate", len(outOfDate))
+	}
+}
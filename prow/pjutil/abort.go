@@ -1,7 +1,12 @@
 package pjutil
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 
 	"github.com/sirupsen/logrus"
 	prowapi "k8s.io/test-infra/prow/kube"
@@ -11,91 +16,380 @@ import (
 type prowClient interface {
 	//ReplaceProwJob replaces the prow job with the given name
 	ReplaceProwJob(string, prowapi.ProwJob) (prowapi.ProwJob, error)
+	// GetProwJob fetches the current version of the prow job with the given name. It is used
+	// to re-evaluate whether an abort is still warranted after a ReplaceProwJob conflict.
+	GetProwJob(string) (prowapi.ProwJob, error)
 }
 
 // ProwJobResourcesCleanupFn type for a callback function which it is expected to clean up
-// all k8s resources associated with the given prow job
-type ProwJobResourcesCleanupFn func(pj prowapi.ProwJob) error
+// all k8s resources associated with the given prow job. reason explains why the job is being
+// aborted, and force is true once the graceful deadline has passed and the cleanup is expected
+// to tear resources down unconditionally rather than asking them to wind down on their own.
+type ProwJobResourcesCleanupFn func(pj prowapi.ProwJob, reason AbortReason, force bool) error
 
 // ProwJobAborter is an interface for abstracting the prow job aborter behaviour
 type ProwJobAborter interface {
 	// TerminateOlderPresubmitJobs aborts all prow presubmit jobs from the given list that
 	// have a newer version, and call the callback on each aborted job
 	TerminateOlderPresubmitJobs(pjs []prowapi.ProwJob, cleanup ProwJobResourcesCleanupFn) error
+	// TerminateOlderPresubmitJobsCtx is TerminateOlderPresubmitJobs with a context that can
+	// be used to cancel in-flight work
+	TerminateOlderPresubmitJobsCtx(ctx context.Context, pjs []prowapi.ProwJob, cleanup ProwJobResourcesCleanupFn) error
+	// TerminateOlderJobs generalizes TerminateOlderPresubmitJobs to any job type and dedup
+	// strategy described by opts
+	TerminateOlderJobs(ctx context.Context, pjs []prowapi.ProwJob, opts TerminateOlderJobsOptions, cleanup ProwJobResourcesCleanupFn) error
+}
+
+// DedupKeyFn computes the key that groups together the versions of a job that are eligible to
+// be deduplicated, e.g. every presubmit run for the same org/repo/PR/job. ok is false if pj does
+// not carry enough information to compute a key (for example a presubmit with no Refs.Pulls),
+// in which case pj is left out of deduplication entirely.
+type DedupKeyFn func(pj prowapi.ProwJob) (key string, ok bool)
+
+// TerminateOlderJobsOptions configures TerminateOlderJobs.
+type TerminateOlderJobsOptions struct {
+	// Types restricts consideration to ProwJobs whose Spec.Type is set in this map.
+	Types map[prowapi.ProwJobType]bool
+	// DedupKey groups ProwJobs that compete for the same slot; only the newest MaxConcurrent
+	// per key are left running.
+	DedupKey DedupKeyFn
+	// MaxConcurrent is how many jobs per dedup key are allowed to survive. Defaults to 1 if
+	// left at its zero value, which is the historical presubmit/postsubmit/batch behavior of
+	// keeping only the single newest job.
+	MaxConcurrent int
+	// Reason is recorded as the AbortReason of every job aborted by this call, and is preserved
+	// even if the job has to be forced into AbortedState by phase 2 - see AbortForcedAnnotation.
+	// Defaults to ReasonSupersededByNewer.
+	Reason AbortReason
+}
+
+// PresubmitDedupKey groups presubmit runs of the same job for the same org/repo/PR, which is
+// the historical behavior of TerminateOlderPresubmitJobs.
+func PresubmitDedupKey(pj prowapi.ProwJob) (string, bool) {
+	if pj.Spec.Refs == nil || len(pj.Spec.Refs.Pulls) == 0 {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%s#%d %s", pj.Spec.Refs.Org, pj.Spec.Refs.Repo, pj.Spec.Refs.Pulls[0].Number, pj.Spec.Job), true
+}
+
+// BatchDedupKey groups batch runs of the same job for the same org/repo over the same set of
+// pulls, regardless of the order the pulls were listed in.
+func BatchDedupKey(pj prowapi.ProwJob) (string, bool) {
+	if pj.Spec.Refs == nil || len(pj.Spec.Refs.Pulls) == 0 {
+		return "", false
+	}
+	pulls := make([]int, 0, len(pj.Spec.Refs.Pulls))
+	for _, pull := range pj.Spec.Refs.Pulls {
+		pulls = append(pulls, pull.Number)
+	}
+	sort.Ints(pulls)
+	return fmt.Sprintf("%s/%s#%v %s", pj.Spec.Refs.Org, pj.Spec.Refs.Repo, pulls, pj.Spec.Job), true
 }
 
+// PostsubmitDedupKey groups postsubmit runs of the same job for the same org/repo/branch.
+func PostsubmitDedupKey(pj prowapi.ProwJob) (string, bool) {
+	if pj.Spec.Refs == nil {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%s@%s %s", pj.Spec.Refs.Org, pj.Spec.Refs.Repo, pj.Spec.Refs.BaseRef, pj.Spec.Job), true
+}
+
+// PeriodicDedupKey groups periodic runs by job name alone, since periodics carry no Refs. Pair
+// it with TerminateOlderJobsOptions.MaxConcurrent to allow more than one concurrent run.
+func PeriodicDedupKey(pj prowapi.ProwJob) (string, bool) {
+	return pj.Spec.Job, true
+}
+
+const (
+	// AbortRequestedAnnotation records the RFC3339 timestamp at which a graceful cancel was
+	// first requested for a ProwJob. Its presence marks a job as being in phase 1 of a
+	// two-phase abort.
+	AbortRequestedAnnotation = "prow.k8s.io/abort-requested"
+	// lastAbortNudgeAnnotation records the RFC3339 timestamp of the last time the graceful
+	// cleanup callback was re-invoked for a job that is still waiting to exit on its own.
+	lastAbortNudgeAnnotation = "prow.k8s.io/last-abort-nudge"
+	// AbortForcedAnnotation marks a ProwJob that was forcibly transitioned to AbortedState by
+	// phase 2 rather than exiting on its own, without disturbing the original AbortReason - so
+	// the audit trail retains both why the abort was requested and how the job actually ended.
+	AbortForcedAnnotation = "prow.k8s.io/abort-forced"
+)
+
+// defaultForceCancelInterval is used when ForceCancelInterval is left at its zero value.
+const defaultForceCancelInterval = 5 * time.Minute
+
 // ProwJobAborter provides functionality to abort prow jobs
 type prowJobAborter struct {
 	pjc prowClient
 	log *logrus.Entry
-}
 
-// jobIndentifier keeps the information required to uniquely identify a prow job
-type jobIndentifier struct {
-	job          string
-	organization string
-	repository   string
-	pullRequest  int
-}
+	// UpdateInterval is the minimum amount of time that must elapse between successive
+	// graceful-cleanup nudges for the same job while it is waiting to exit on its own.
+	UpdateInterval time.Duration
+	// ForceCancelInterval is how long a job is given to reach a terminal state after a
+	// graceful cancel before it is forcibly transitioned to AbortedState.
+	ForceCancelInterval time.Duration
 
-// Strings returns the string representation of a prow job identifier
-func (i *jobIndentifier) String() string {
-	return fmt.Sprintf("%s %s/%s#%d", i.job, i.organization, i.repository, i.pullRequest)
+	// acquirer, when set, is used to serialize aborts of the same dedup key across competing
+	// plutil consumers (plank, tide, crier, external tools). A nil acquirer disables leasing,
+	// which is fine for single-consumer callers and existing tests.
+	acquirer *Acquirer
 }
 
-//NewProwJobAborter creates a new ProwJobAborter
-func NewProwJobAborter(pjc prowClient, log *logrus.Entry) *prowJobAborter {
+// NewProwJobAborter creates a new ProwJobAborter. updateInterval and forceCancelInterval
+// control the two-phase graceful abort: updateInterval paces how often the graceful cleanup
+// callback is re-invoked while a job is waiting to exit on its own, and forceCancelInterval
+// is the deadline after which a job that has not reached a terminal state is forcibly aborted.
+// A zero forceCancelInterval falls back to defaultForceCancelInterval.
+func NewProwJobAborter(pjc prowClient, log *logrus.Entry, updateInterval, forceCancelInterval time.Duration) *prowJobAborter {
+	if forceCancelInterval == 0 {
+		forceCancelInterval = defaultForceCancelInterval
+	}
 	return &prowJobAborter{
-		log: log,
-		pjc: pjc,
+		log:                 log,
+		pjc:                 pjc,
+		UpdateInterval:      updateInterval,
+		ForceCancelInterval: forceCancelInterval,
 	}
 }
 
+// WithAcquirer configures the aborter to serialize aborts of the same job through acquirer
+// before mutating it, so that competing plutil consumers racing to abort or replace the same
+// ProwJob cannot step on one another.
+func (a *prowJobAborter) WithAcquirer(acquirer *Acquirer) *prowJobAborter {
+	a.acquirer = acquirer
+	return a
+}
+
+// presubmitDedupOptions is the TerminateOlderJobsOptions that reproduces the historical,
+// presubmit-only behavior of TerminateOlderPresubmitJobs.
+var presubmitDedupOptions = TerminateOlderJobsOptions{
+	Types:    map[prowapi.ProwJobType]bool{prowapi.PresubmitJob: true},
+	DedupKey: PresubmitDedupKey,
+	Reason:   ReasonSupersededByNewer,
+}
+
 // TerminateOlderPresubmitJobs aborts all presubmit jobs from the given list that have a newer version. It calls
 // the cleanup callback for each job before updating its status as aborted.
 func (a *prowJobAborter) TerminateOlderPresubmitJobs(pjs []prowapi.ProwJob, cleanup ProwJobResourcesCleanupFn) error {
-	dupes := make(map[jobIndentifier]int)
+	return a.TerminateOlderPresubmitJobsCtx(context.Background(), pjs, cleanup)
+}
+
+// TerminateOlderPresubmitJobsCtx is TerminateOlderPresubmitJobs with a context that can be used
+// to cancel in-flight work. It is a thin wrapper around TerminateOlderJobs, kept for backward
+// compatibility with existing callers.
+func (a *prowJobAborter) TerminateOlderPresubmitJobsCtx(ctx context.Context, pjs []prowapi.ProwJob, cleanup ProwJobResourcesCleanupFn) error {
+	return a.TerminateOlderJobs(ctx, pjs, presubmitDedupOptions, cleanup)
+}
+
+// TerminateOlderJobs aborts all jobs from the given list that are of an eligible type (per
+// opts.Types), grouped by opts.DedupKey, beyond the newest opts.MaxConcurrent per group.
+// Superseded jobs are aborted in two phases: phase 1 requests a graceful cancel and gives the
+// underlying pod/build up to ForceCancelInterval to exit on its own; phase 2, once that deadline
+// has passed without the job reaching a terminal state, forces the transition to AbortedState.
+// ctx is checked before each job is aborted, so cancelling it stops further aborts without
+// interrupting one already in flight.
+func (a *prowJobAborter) TerminateOlderJobs(ctx context.Context, pjs []prowapi.ProwJob, opts TerminateOlderJobsOptions, cleanup ProwJobResourcesCleanupFn) error {
+	maxConcurrent := opts.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+	reason := opts.Reason
+	if reason == "" {
+		reason = ReasonSupersededByNewer
+	}
+
+	groups := make(map[string][]int)
 	for i, pj := range pjs {
-		if pj.Complete() || pj.Spec.Type != prowapi.PresubmitJob {
+		if pj.Complete() || !opts.Types[pj.Spec.Type] {
 			continue
 		}
-
-		ji := jobIndentifier{
-			job:          pj.Spec.Job,
-			organization: pj.Spec.Refs.Org,
-			repository:   pj.Spec.Refs.Repo,
-			pullRequest:  pj.Spec.Refs.Pulls[0].Number,
-		}
-		prev, ok := dupes[ji]
+		key, ok := opts.DedupKey(pj)
 		if !ok {
-			dupes[ji] = i
 			continue
 		}
-		cancelIndex := i
-		if (&pjs[prev].Status.StartTime).Before(&pj.Status.StartTime) {
-			cancelIndex = prev
-			dupes[ji] = i
-		}
-		toCancel := pjs[cancelIndex]
+		groups[key] = append(groups[key], i)
+	}
 
-		err := cleanup(toCancel)
-		if err != nil {
-			a.log.WithError(err).WithFields(ProwJobFields(&toCancel)).Warn("Cannot cleanup underlying resources")
+	for key, indices := range groups {
+		if len(indices) <= maxConcurrent {
+			continue
 		}
 
-		toCancel.SetComplete()
-		prevState := toCancel.Status.State
-		toCancel.Status.State = prowapi.AbortedState
-		a.log.WithFields(ProwJobFields(&toCancel)).
-			WithField("from", prevState).
-			WithField("to", toCancel.Status.State).Info("Transitioning states")
+		sort.Slice(indices, func(x, y int) bool {
+			return pjs[indices[y]].Status.StartTime.Before(&pjs[indices[x]].Status.StartTime)
+		})
+
+		for _, idx := range indices[maxConcurrent:] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			toCancel := pjs[idx]
+
+			if a.acquirer != nil {
+				acquired, err := a.acquirer.Acquire(key)
+				if err != nil {
+					return err
+				}
+				if !acquired {
+					a.log.WithFields(ProwJobFields(&toCancel)).Info("Another holder is already aborting this job, skipping")
+					continue
+				}
+			}
+
+			npj, err := a.abortOne(ctx, toCancel, cleanup, reason)
+
+			if a.acquirer != nil {
+				if releaseErr := a.acquirer.Release(key); releaseErr != nil {
+					a.log.WithError(releaseErr).WithFields(ProwJobFields(&toCancel)).Warn("Failed to release abort lease")
+				}
+			}
 
-		npj, err := a.pjc.ReplaceProwJob(toCancel.ObjectMeta.Name, toCancel)
-		if err != nil {
-			return err
+			if err != nil {
+				return err
+			}
+			pjs[idx] = npj
 		}
-		pjs[cancelIndex] = npj
 	}
 
 	return nil
 }
+
+// abortOne drives a single ProwJob through the two-phase abort: a graceful request followed,
+// after ForceCancelInterval has elapsed without the job reaching a terminal state, by a forced
+// transition to AbortedState.
+func (a *prowJobAborter) abortOne(ctx context.Context, pj prowapi.ProwJob, cleanup ProwJobResourcesCleanupFn, reason AbortReason) (prowapi.ProwJob, error) {
+	requestedAt, phase1Started := pj.ObjectMeta.Annotations[AbortRequestedAnnotation]
+	if !phase1Started {
+		return a.requestGracefulCancel(ctx, pj, cleanup, reason)
+	}
+
+	requestedTime, err := time.Parse(time.RFC3339, requestedAt)
+	if err != nil {
+		a.log.WithError(err).WithFields(ProwJobFields(&pj)).Warn("Could not parse abort-requested annotation, treating as just requested")
+		return a.requestGracefulCancel(ctx, pj, cleanup, reason)
+	}
+
+	if time.Since(requestedTime) < a.ForceCancelInterval {
+		return a.nudgeGracefulCancel(ctx, pj, cleanup, requestedTime, reason)
+	}
+
+	return a.forceCancel(ctx, pj, cleanup, requestedTime)
+}
+
+// requestGracefulCancel is phase 1: it marks the job as having a graceful cancel in flight and
+// invokes cleanup, but leaves the job's state untouched so the underlying pod/build has a
+// chance to exit and post its own final status.
+func (a *prowJobAborter) requestGracefulCancel(ctx context.Context, pj prowapi.ProwJob, cleanup ProwJobResourcesCleanupFn, reason AbortReason) (prowapi.ProwJob, error) {
+	now := time.Now()
+	if pj.ObjectMeta.Annotations == nil {
+		pj.ObjectMeta.Annotations = map[string]string{}
+	}
+	pj.ObjectMeta.Annotations[AbortRequestedAnnotation] = now.Format(time.RFC3339)
+	pj.ObjectMeta.Annotations[lastAbortNudgeAnnotation] = now.Format(time.RFC3339)
+	pj.ObjectMeta.Annotations[AbortReasonAnnotation] = string(reason)
+	pj.Status.AbortReason = string(reason)
+
+	if err := cleanup(pj, reason, false); err != nil {
+		a.log.WithError(err).WithFields(ProwJobFields(&pj)).Warn("Cannot cleanup underlying resources")
+	}
+
+	prevState := pj.Status.State
+	a.log.WithFields(ProwJobFields(&pj)).
+		WithField("from", prevState).
+		WithField("to", prevState).
+		WithField("phase", 1).
+		WithField("reason", reason).
+		WithField("elapsed", time.Duration(0)).Info("Transitioning states")
+
+	return a.replace(pj)
+}
+
+// nudgeGracefulCancel re-invokes the graceful cleanup callback while still in phase 1, but no
+// more often than UpdateInterval, so as not to hammer the underlying pod/build.
+func (a *prowJobAborter) nudgeGracefulCancel(ctx context.Context, pj prowapi.ProwJob, cleanup ProwJobResourcesCleanupFn, requestedTime time.Time, reason AbortReason) (prowapi.ProwJob, error) {
+	lastNudge := requestedTime
+	if raw, ok := pj.ObjectMeta.Annotations[lastAbortNudgeAnnotation]; ok {
+		if parsed, err := time.Parse(time.RFC3339, raw); err == nil {
+			lastNudge = parsed
+		}
+	}
+
+	if a.UpdateInterval > 0 && time.Since(lastNudge) < a.UpdateInterval {
+		return pj, nil
+	}
+
+	if err := cleanup(pj, reason, false); err != nil {
+		a.log.WithError(err).WithFields(ProwJobFields(&pj)).Warn("Cannot cleanup underlying resources")
+	}
+	pj.ObjectMeta.Annotations[lastAbortNudgeAnnotation] = time.Now().Format(time.RFC3339)
+
+	a.log.WithFields(ProwJobFields(&pj)).
+		WithField("from", pj.Status.State).
+		WithField("to", pj.Status.State).
+		WithField("phase", 1).
+		WithField("reason", reason).
+		WithField("elapsed", time.Since(requestedTime)).Info("Transitioning states")
+
+	return a.replace(pj)
+}
+
+// forceCancel is phase 2: the graceful deadline has passed, so the job is forcibly transitioned
+// to AbortedState regardless of whether cleanup succeeds. It preserves whatever AbortReason was
+// recorded in phase 1 instead of overwriting it with ReasonForcedAfterTimeout, and separately
+// marks the job as forced via AbortForcedAnnotation, so the original cause of the abort survives
+// alongside the fact that the job didn't exit on its own in time.
+func (a *prowJobAborter) forceCancel(ctx context.Context, pj prowapi.ProwJob, cleanup ProwJobResourcesCleanupFn, requestedTime time.Time) (prowapi.ProwJob, error) {
+	reason := EffectiveAbortReason(AbortReason(pj.Status.AbortReason))
+	if reason == ReasonUnknown {
+		reason = ReasonForcedAfterTimeout
+	}
+
+	if err := cleanup(pj, reason, true); err != nil {
+		a.log.WithError(err).WithFields(ProwJobFields(&pj)).Warn("Cannot cleanup underlying resources after force-cancel")
+	}
+
+	pj.SetComplete()
+	prevState := pj.Status.State
+	pj.Status.State = prowapi.AbortedState
+	pj.Status.AbortReason = string(reason)
+	if pj.ObjectMeta.Annotations == nil {
+		pj.ObjectMeta.Annotations = map[string]string{}
+	}
+	pj.ObjectMeta.Annotations[AbortReasonAnnotation] = string(reason)
+	pj.ObjectMeta.Annotations[AbortForcedAnnotation] = "true"
+
+	prowJobAbortsTotal.WithLabelValues(string(reason)).Inc()
+
+	a.log.WithFields(ProwJobFields(&pj)).
+		WithField("from", prevState).
+		WithField("to", pj.Status.State).
+		WithField("phase", 2).
+		WithField("reason", reason).
+		WithField("forced", true).
+		WithField("elapsed", time.Since(requestedTime)).Info("Transitioning states")
+
+	return a.replace(pj)
+}
+
+// replace persists pj, retrying once on a 409 conflict. On conflict, it re-fetches the current
+// version of the job: if that version has since reached a terminal state, a competing process
+// has already superseded it, so replace backs off instead of clobbering that result.
+func (a *prowJobAborter) replace(pj prowapi.ProwJob) (prowapi.ProwJob, error) {
+	npj, err := a.pjc.ReplaceProwJob(pj.ObjectMeta.Name, pj)
+	if err == nil || !k8serrors.IsConflict(err) {
+		return npj, err
+	}
+
+	current, getErr := a.pjc.GetProwJob(pj.ObjectMeta.Name)
+	if getErr != nil {
+		return npj, err
+	}
+	if current.Complete() {
+		a.log.WithFields(ProwJobFields(&current)).Info("Job was already completed by another process, not retrying abort")
+		return current, nil
+	}
+
+	pj.ObjectMeta.ResourceVersion = current.ObjectMeta.ResourceVersion
+	return a.pjc.ReplaceProwJob(pj.ObjectMeta.Name, pj)
+}
@@ -0,0 +1,559 @@
+package pjutil
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	prowapi "k8s.io/test-infra/prow/kube"
+)
+
+// fakeConfigMapClient is a minimal, in-memory configMapClient for exercising
+// configMapLeaseStore, including its conflict-retry loop, without a real API server.
+type fakeConfigMapClient struct {
+	cm *corev1.ConfigMap
+
+	// failNextUpdate, if greater than zero, causes that many subsequent Update calls to return a
+	// conflict error before one is allowed to succeed.
+	failNextUpdate int
+
+	updateCalls int
+}
+
+func (c *fakeConfigMapClient) Get(name string) (*corev1.ConfigMap, error) {
+	if c.cm == nil {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	out := *c.cm
+	out.Data = map[string]string{}
+	for k, v := range c.cm.Data {
+		out.Data[k] = v
+	}
+	return &out, nil
+}
+
+func (c *fakeConfigMapClient) Create(cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	if c.cm != nil {
+		return nil, k8serrors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+	}
+	c.cm = cm
+	return cm, nil
+}
+
+func (c *fakeConfigMapClient) Update(cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	c.updateCalls++
+	if c.failNextUpdate > 0 {
+		c.failNextUpdate--
+		return nil, k8serrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, cm.Name, fmt.Errorf("conflicting update"))
+	}
+	c.cm = cm
+	return cm, nil
+}
+
+// fakeProwJobClient is a minimal, in-memory prowClient for exercising the aborter's state
+// machine without a real Kubernetes API server.
+type fakeProwJobClient struct {
+	jobs map[string]prowapi.ProwJob
+
+	// failNextReplace, when true for a job name, causes the next ReplaceProwJob call for that
+	// name to return a conflict error instead of succeeding, to exercise replace's retry path.
+	failNextReplace map[string]bool
+
+	replaceCalls int
+}
+
+func newFakeProwJobClient(jobs ...prowapi.ProwJob) *fakeProwJobClient {
+	c := &fakeProwJobClient{jobs: map[string]prowapi.ProwJob{}, failNextReplace: map[string]bool{}}
+	for _, pj := range jobs {
+		c.jobs[pj.ObjectMeta.Name] = pj
+	}
+	return c
+}
+
+func (c *fakeProwJobClient) ReplaceProwJob(name string, pj prowapi.ProwJob) (prowapi.ProwJob, error) {
+	c.replaceCalls++
+	if c.failNextReplace[name] {
+		delete(c.failNextReplace, name)
+		return prowapi.ProwJob{}, k8serrors.NewConflict(schema.GroupResource{Resource: "prowjobs"}, name, fmt.Errorf("conflicting update"))
+	}
+	c.jobs[name] = pj
+	return pj, nil
+}
+
+func (c *fakeProwJobClient) GetProwJob(name string) (prowapi.ProwJob, error) {
+	pj, ok := c.jobs[name]
+	if !ok {
+		return prowapi.ProwJob{}, fmt.Errorf("no such prowjob %q", name)
+	}
+	return pj, nil
+}
+
+func noopCleanup(prowapi.ProwJob, AbortReason, bool) error { return nil }
+
+func TestAbortOneTwoPhase(t *testing.T) {
+	pj := prowapi.ProwJob{ObjectMeta: metav1.ObjectMeta{Name: "job-1"}}
+	client := newFakeProwJobClient(pj)
+	a := NewProwJobAborter(client, logrus.WithField("test", t.Name()), 0, time.Minute)
+
+	var forcedCalls []bool
+	cleanup := func(_ prowapi.ProwJob, _ AbortReason, force bool) error {
+		forcedCalls = append(forcedCalls, force)
+		return nil
+	}
+
+	phase1, err := a.abortOne(context.Background(), pj, cleanup, ReasonManualCancel)
+	if err != nil {
+		t.Fatalf("unexpected error requesting graceful cancel: %v", err)
+	}
+	if phase1.Status.State != "" {
+		t.Errorf("phase 1 should not transition Status.State, got %q", phase1.Status.State)
+	}
+	if phase1.Status.AbortReason != string(ReasonManualCancel) {
+		t.Errorf("expected AbortReason %q, got %q", ReasonManualCancel, phase1.Status.AbortReason)
+	}
+	if _, ok := phase1.ObjectMeta.Annotations[AbortRequestedAnnotation]; !ok {
+		t.Error("expected AbortRequestedAnnotation to be set after phase 1")
+	}
+
+	// Simulate the force-cancel deadline having already passed.
+	phase1.ObjectMeta.Annotations[AbortRequestedAnnotation] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+
+	phase2, err := a.abortOne(context.Background(), phase1, cleanup, ReasonManualCancel)
+	if err != nil {
+		t.Fatalf("unexpected error force-cancelling: %v", err)
+	}
+	if phase2.Status.State != prowapi.AbortedState {
+		t.Errorf("expected Status.State %q, got %q", prowapi.AbortedState, phase2.Status.State)
+	}
+	if phase2.Status.AbortReason != string(ReasonManualCancel) {
+		t.Errorf("expected the original AbortReason %q to survive force-cancel, got %q", ReasonManualCancel, phase2.Status.AbortReason)
+	}
+	if phase2.ObjectMeta.Annotations[AbortForcedAnnotation] != "true" {
+		t.Error("expected AbortForcedAnnotation to be set after force-cancel")
+	}
+	if len(forcedCalls) != 2 || forcedCalls[0] || !forcedCalls[1] {
+		t.Errorf("expected cleanup to be called with force=false then force=true, got %v", forcedCalls)
+	}
+}
+
+func TestAbortOneNudgesMidPhase1(t *testing.T) {
+	requestedTime := time.Now().Add(-time.Minute)
+	pj := prowapi.ProwJob{ObjectMeta: metav1.ObjectMeta{
+		Name: "job-1",
+		Annotations: map[string]string{
+			AbortRequestedAnnotation: requestedTime.Format(time.RFC3339),
+			lastAbortNudgeAnnotation: requestedTime.Format(time.RFC3339),
+		},
+	}}
+	client := newFakeProwJobClient(pj)
+	// ForceCancelInterval is long enough that requestedTime (1m ago) is still within phase 1.
+	a := NewProwJobAborter(client, logrus.WithField("test", t.Name()), time.Hour, time.Hour)
+
+	cleanupCalls := 0
+	cleanup := func(prowapi.ProwJob, AbortReason, bool) error {
+		cleanupCalls++
+		return nil
+	}
+
+	got, err := a.abortOne(context.Background(), pj, cleanup, ReasonManualCancel)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cleanupCalls != 0 {
+		t.Errorf("expected cleanup to be suppressed within UpdateInterval of the last nudge, got %d calls", cleanupCalls)
+	}
+	if got.ObjectMeta.Annotations[lastAbortNudgeAnnotation] != requestedTime.Format(time.RFC3339) {
+		t.Error("expected lastAbortNudgeAnnotation to be left untouched when the nudge is suppressed")
+	}
+
+	// Once UpdateInterval has actually elapsed since the last nudge, the next call should nudge.
+	a.UpdateInterval = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+
+	got, err = a.abortOne(context.Background(), got, cleanup, ReasonManualCancel)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cleanupCalls != 1 {
+		t.Errorf("expected cleanup to be invoked once UpdateInterval has elapsed, got %d calls", cleanupCalls)
+	}
+	if got.ObjectMeta.Annotations[lastAbortNudgeAnnotation] == requestedTime.Format(time.RFC3339) {
+		t.Error("expected lastAbortNudgeAnnotation to be refreshed after a nudge")
+	}
+	if got.Status.State != "" {
+		t.Errorf("a nudge must not transition Status.State, got %q", got.Status.State)
+	}
+}
+
+func TestTerminateOlderJobsStopsOnCancelledContext(t *testing.T) {
+	older := prowapi.ProwJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "postsubmit-older"},
+		Spec: prowapi.ProwJobSpec{
+			Type: prowapi.PostsubmitJob,
+			Job:  "push-tests",
+			Refs: &prowapi.Refs{Org: "org", Repo: "repo", BaseRef: "main"},
+		},
+		Status: prowapi.ProwJobStatus{StartTime: metav1.NewTime(time.Now().Add(-time.Hour))},
+	}
+	newer := older
+	newer.ObjectMeta.Name = "postsubmit-newer"
+	newer.Status.StartTime = metav1.NewTime(time.Now())
+
+	client := newFakeProwJobClient(older, newer)
+	a := NewProwJobAborter(client, logrus.WithField("test", t.Name()), 0, time.Minute)
+
+	opts := TerminateOlderJobsOptions{
+		Types:    map[prowapi.ProwJobType]bool{prowapi.PostsubmitJob: true},
+		DedupKey: PostsubmitDedupKey,
+		Reason:   ReasonSupersededByNewer,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := a.TerminateOlderJobs(ctx, []prowapi.ProwJob{older, newer}, opts, noopCleanup); err == nil {
+		t.Fatal("expected a cancelled context to stop TerminateOlderJobs with an error")
+	}
+
+	untouched, err := client.GetProwJob("postsubmit-older")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := untouched.ObjectMeta.Annotations[AbortRequestedAnnotation]; ok {
+		t.Error("expected a cancelled context to prevent any abort from starting")
+	}
+}
+
+func TestTerminateOlderJobsGeneralizedDedup(t *testing.T) {
+	older := prowapi.ProwJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "postsubmit-older"},
+		Spec: prowapi.ProwJobSpec{
+			Type: prowapi.PostsubmitJob,
+			Job:  "push-tests",
+			Refs: &prowapi.Refs{Org: "org", Repo: "repo", BaseRef: "main"},
+		},
+		Status: prowapi.ProwJobStatus{StartTime: metav1.NewTime(time.Now().Add(-time.Hour))},
+	}
+	newer := older
+	newer.ObjectMeta.Name = "postsubmit-newer"
+	newer.Status.StartTime = metav1.NewTime(time.Now())
+
+	client := newFakeProwJobClient(older, newer)
+	a := NewProwJobAborter(client, logrus.WithField("test", t.Name()), 0, time.Minute)
+
+	opts := TerminateOlderJobsOptions{
+		Types:    map[prowapi.ProwJobType]bool{prowapi.PostsubmitJob: true},
+		DedupKey: PostsubmitDedupKey,
+		Reason:   ReasonSupersededByNewer,
+	}
+
+	if err := a.TerminateOlderJobs(context.Background(), []prowapi.ProwJob{older, newer}, opts, noopCleanup); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	aborted, err := client.GetProwJob("postsubmit-older")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := aborted.ObjectMeta.Annotations[AbortRequestedAnnotation]; !ok {
+		t.Error("expected the older postsubmit to have an abort requested")
+	}
+
+	untouched, err := client.GetProwJob("postsubmit-newer")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := untouched.ObjectMeta.Annotations[AbortRequestedAnnotation]; ok {
+		t.Error("expected the newer postsubmit to be left alone")
+	}
+}
+
+func TestReplaceRetriesOnConflict(t *testing.T) {
+	pj := prowapi.ProwJob{ObjectMeta: metav1.ObjectMeta{Name: "job-1", ResourceVersion: "1"}}
+	client := newFakeProwJobClient(pj)
+	client.failNextReplace["job-1"] = true
+	a := NewProwJobAborter(client, logrus.WithField("test", t.Name()), 0, time.Minute)
+
+	toReplace := pj
+	toReplace.Status.State = prowapi.AbortedState
+
+	got, err := a.replace(toReplace)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Status.State != prowapi.AbortedState {
+		t.Errorf("expected the retried replace to persist Status.State %q, got %q", prowapi.AbortedState, got.Status.State)
+	}
+	if client.replaceCalls != 2 {
+		t.Errorf("expected ReplaceProwJob to be called twice (initial attempt + retry), got %d", client.replaceCalls)
+	}
+}
+
+func TestReplaceBacksOffIfAlreadyCompletedByAnotherProcess(t *testing.T) {
+	completionTime := metav1.NewTime(time.Now())
+	completed := prowapi.ProwJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "job-1", ResourceVersion: "2"},
+		Status:     prowapi.ProwJobStatus{State: prowapi.SuccessState, CompletionTime: &completionTime},
+	}
+	client := newFakeProwJobClient(completed)
+	client.failNextReplace["job-1"] = true
+	a := NewProwJobAborter(client, logrus.WithField("test", t.Name()), 0, time.Minute)
+
+	stale := completed
+	stale.ObjectMeta.ResourceVersion = "1"
+	stale.Status.State = prowapi.AbortedState
+	stale.Status.CompletionTime = nil
+
+	got, err := a.replace(stale)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Status.State != prowapi.SuccessState {
+		t.Errorf("expected replace to back off and return the already-completed job, got state %q", got.Status.State)
+	}
+	if client.replaceCalls != 1 {
+		t.Errorf("expected replace not to retry once the current version is already complete, got %d calls", client.replaceCalls)
+	}
+}
+
+func TestAcquirerPreventsDuplicateAbort(t *testing.T) {
+	store := NewInMemoryLeaseStore()
+	first := NewAcquirer(store, "holder-a", time.Minute)
+	second := NewAcquirer(store, "holder-b", time.Minute)
+
+	key := "org/repo#1 some-job"
+
+	acquired, err := first.Acquire(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !acquired {
+		t.Fatal("expected first acquirer to acquire the lease")
+	}
+
+	acquired, err = second.Acquire(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if acquired {
+		t.Fatal("expected second acquirer to be denied the lease while the first holds it")
+	}
+
+	if err := first.Release(key); err != nil {
+		t.Fatalf("unexpected error releasing lease: %v", err)
+	}
+
+	acquired, err = second.Acquire(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !acquired {
+		t.Fatal("expected second acquirer to acquire the lease once the first released it")
+	}
+}
+
+func TestAcquirerReleaseIsScopedToHolder(t *testing.T) {
+	store := NewInMemoryLeaseStore()
+	first := NewAcquirer(store, "holder-a", time.Minute)
+	second := NewAcquirer(store, "holder-b", time.Minute)
+
+	key := "org/repo#1 some-job"
+
+	if _, err := first.Acquire(key); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Releasing with a different holder must not free a lease it does not own.
+	if err := second.Release(key); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	acquired, err := second.Acquire(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if acquired {
+		t.Fatal("expected second acquirer's no-op release to leave the first acquirer's lease intact")
+	}
+}
+
+func TestAcquirerLeaseExpires(t *testing.T) {
+	store := NewInMemoryLeaseStore()
+	first := NewAcquirer(store, "holder-a", time.Millisecond)
+	second := NewAcquirer(store, "holder-b", time.Minute)
+
+	key := "org/repo#1 some-job"
+
+	if _, err := first.Acquire(key); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	acquired, err := second.Acquire(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !acquired {
+		t.Fatal("expected second acquirer to acquire the lease once the first one expired")
+	}
+}
+
+func TestConfigMapLeaseStorePreventsDuplicateAbort(t *testing.T) {
+	client := &fakeConfigMapClient{}
+	store := NewConfigMapLeaseStore(client, "abort-leases")
+
+	key := "org/repo#1 some-job"
+
+	acquired, err := store.Acquire(key, "holder-a", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !acquired {
+		t.Fatal("expected the first holder to acquire the lease")
+	}
+
+	acquired, err = store.Acquire(key, "holder-b", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if acquired {
+		t.Fatal("expected the second holder to be denied the lease while the first holds it")
+	}
+
+	if err := store.Release(key, "holder-a"); err != nil {
+		t.Fatalf("unexpected error releasing lease: %v", err)
+	}
+
+	acquired, err = store.Acquire(key, "holder-b", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !acquired {
+		t.Fatal("expected the second holder to acquire the lease once the first released it")
+	}
+}
+
+func TestConfigMapLeaseStorePrunesExpiredLeases(t *testing.T) {
+	client := &fakeConfigMapClient{cm: &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "abort-leases"},
+		Data: map[string]string{
+			"org/repo#1 stale-job": formatLease("crashed-holder", time.Now().Add(-time.Hour)),
+		},
+	}}
+	store := NewConfigMapLeaseStore(client, "abort-leases")
+
+	if _, err := store.Acquire("org/repo#2 some-job", "holder-a", time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := client.cm.Data["org/repo#1 stale-job"]; ok {
+		t.Error("expected the expired lease to be pruned by the next Acquire call")
+	}
+}
+
+func TestConfigMapLeaseStoreRetriesOnConflict(t *testing.T) {
+	client := &fakeConfigMapClient{failNextUpdate: 1}
+	store := NewConfigMapLeaseStore(client, "abort-leases")
+
+	acquired, err := store.Acquire("org/repo#1 some-job", "holder-a", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !acquired {
+		t.Fatal("expected the lease to be acquired after retrying past the conflict")
+	}
+	if client.updateCalls != 2 {
+		t.Errorf("expected Update to be called twice (initial attempt + retry), got %d", client.updateCalls)
+	}
+}
+
+func TestNewProwJobAborterDefaultsForceCancelInterval(t *testing.T) {
+	log := logrus.WithField("test", t.Name())
+	a := NewProwJobAborter(nil, log, 0, 0)
+	if a.ForceCancelInterval != defaultForceCancelInterval {
+		t.Errorf("expected default ForceCancelInterval of %s, got %s", defaultForceCancelInterval, a.ForceCancelInterval)
+	}
+}
+
+func TestDedupKeyFns(t *testing.T) {
+	tests := []struct {
+		name     string
+		dedupKey DedupKeyFn
+		pj       prowapi.ProwJob
+		wantKey  string
+		wantOk   bool
+	}{
+		{
+			name:     "presubmit key includes org/repo/pr/job",
+			dedupKey: PresubmitDedupKey,
+			pj: prowapi.ProwJob{Spec: prowapi.ProwJobSpec{
+				Job:  "unit-tests",
+				Type: prowapi.PresubmitJob,
+				Refs: &prowapi.Refs{Org: "org", Repo: "repo", Pulls: []prowapi.Pull{{Number: 5}}},
+			}},
+			wantKey: "org/repo#5 unit-tests",
+			wantOk:  true,
+		},
+		{
+			name:     "presubmit key rejects nil refs",
+			dedupKey: PresubmitDedupKey,
+			pj:       prowapi.ProwJob{Spec: prowapi.ProwJobSpec{Job: "unit-tests", Type: prowapi.PresubmitJob}},
+			wantOk:   false,
+		},
+		{
+			name:     "batch key ignores pull order",
+			dedupKey: BatchDedupKey,
+			pj: prowapi.ProwJob{Spec: prowapi.ProwJobSpec{
+				Job:  "batch-tests",
+				Type: prowapi.BatchJob,
+				Refs: &prowapi.Refs{Org: "org", Repo: "repo", Pulls: []prowapi.Pull{{Number: 5}, {Number: 3}}},
+			}},
+			wantKey: "org/repo#[3 5] batch-tests",
+			wantOk:  true,
+		},
+		{
+			name:     "postsubmit key includes branch",
+			dedupKey: PostsubmitDedupKey,
+			pj: prowapi.ProwJob{Spec: prowapi.ProwJobSpec{
+				Job:  "push-tests",
+				Type: prowapi.PostsubmitJob,
+				Refs: &prowapi.Refs{Org: "org", Repo: "repo", BaseRef: "main"},
+			}},
+			wantKey: "org/repo@main push-tests",
+			wantOk:  true,
+		},
+		{
+			name:     "postsubmit key rejects nil refs",
+			dedupKey: PostsubmitDedupKey,
+			pj:       prowapi.ProwJob{Spec: prowapi.ProwJobSpec{Job: "push-tests", Type: prowapi.PostsubmitJob}},
+			wantOk:   false,
+		},
+		{
+			name:     "periodic key is the job name, even with nil refs",
+			dedupKey: PeriodicDedupKey,
+			pj:       prowapi.ProwJob{Spec: prowapi.ProwJobSpec{Job: "nightly", Type: prowapi.PeriodicJob}},
+			wantKey:  "nightly",
+			wantOk:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, ok := test.dedupKey(test.pj)
+			if ok != test.wantOk {
+				t.Fatalf("expected ok=%v, got %v", test.wantOk, ok)
+			}
+			if ok && key != test.wantKey {
+				t.Errorf("expected key %q, got %q", test.wantKey, key)
+			}
+		})
+	}
+}
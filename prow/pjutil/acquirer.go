@@ -0,0 +1,255 @@
+package pjutil
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func init() {
+	prometheus.MustRegister(leaseAcquireTotal)
+}
+
+var leaseAcquireTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "prowjob_abort_lease_acquire_total",
+	Help: "Count of abort-lease acquisition attempts, by result.",
+}, []string{"result"})
+
+// LeaseStore is the pluggable backend that an Acquirer uses to atomically record which holder
+// currently owns the right to abort a given ProwJob. Implementations must make Acquire and
+// Release safe for concurrent use, since plank, tide, crier, and external tools may all be
+// racing to abort the same job.
+type LeaseStore interface {
+	// Acquire records holder as the owner of key for ttl if and only if key is unheld or its
+	// existing lease has expired. It returns false, without error, if another holder currently
+	// owns a live lease for key.
+	Acquire(key, holder string, ttl time.Duration) (bool, error)
+	// Release drops the lease for key, but only if it is currently held by holder. Releasing a
+	// key held by someone else (or already free) is a no-op.
+	Release(key, holder string) error
+}
+
+// inMemoryLease is a single entry in the in-memory LeaseStore.
+type inMemoryLease struct {
+	holder  string
+	expires time.Time
+}
+
+// inMemoryLeaseStore is a LeaseStore backed by a plain map, suitable for unit tests and for
+// single-process deployments that do not need the lease to survive a restart.
+type inMemoryLeaseStore struct {
+	mu     sync.Mutex
+	leases map[string]inMemoryLease
+}
+
+// NewInMemoryLeaseStore creates a LeaseStore backed by an in-process map. It is primarily
+// intended for tests; production deployments with more than one plutil consumer should back the
+// Acquirer with NewConfigMapLeaseStore instead, since an in-memory lease is invisible to other
+// processes and so cannot actually prevent them from racing to abort the same ProwJob.
+func NewInMemoryLeaseStore() LeaseStore {
+	return &inMemoryLeaseStore{leases: map[string]inMemoryLease{}}
+}
+
+func (s *inMemoryLeaseStore) Acquire(key, holder string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.leases[key]; ok && existing.holder != holder && time.Now().Before(existing.expires) {
+		return false, nil
+	}
+
+	s.leases[key] = inMemoryLease{holder: holder, expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (s *inMemoryLeaseStore) Release(key, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.leases[key]; ok && existing.holder == holder {
+		delete(s.leases, key)
+	}
+	return nil
+}
+
+// configMapClient is the minimal Kubernetes client surface configMapLeaseStore needs to persist
+// leases in a single ConfigMap.
+type configMapClient interface {
+	Get(name string) (*corev1.ConfigMap, error)
+	Create(cm *corev1.ConfigMap) (*corev1.ConfigMap, error)
+	Update(cm *corev1.ConfigMap) (*corev1.ConfigMap, error)
+}
+
+// configMapLeaseStore is a LeaseStore backed by a single Kubernetes ConfigMap, so that lease
+// state is visible to, and contended over by, every replica of every plutil consumer (plank,
+// tide, crier, external tools) rather than just the process that acquired it. Each lease is
+// stored as one ConfigMap Data entry, "<holder>,<expiresRFC3339Nano>", keyed by the dedup key.
+// Acquire and Release retry on a 409 conflict rather than taking a lock, since the ConfigMap's
+// ResourceVersion is itself the source of truth for concurrent writers.
+type configMapLeaseStore struct {
+	client configMapClient
+	name   string
+}
+
+// NewConfigMapLeaseStore creates a LeaseStore backed by the named ConfigMap, creating it on first
+// use if it does not already exist. Use this instead of NewInMemoryLeaseStore for any deployment
+// where more than one plutil consumer may race to abort the same ProwJob.
+func NewConfigMapLeaseStore(client configMapClient, name string) LeaseStore {
+	return &configMapLeaseStore{client: client, name: name}
+}
+
+func (s *configMapLeaseStore) Acquire(key, holder string, ttl time.Duration) (bool, error) {
+	for {
+		cm, err := s.getOrCreate()
+		if err != nil {
+			return false, err
+		}
+
+		now := time.Now()
+		pruneExpiredLeases(cm, now, key)
+
+		if raw, ok := cm.Data[key]; ok {
+			if existingHolder, expires, err := parseLease(raw); err == nil && existingHolder != holder && now.Before(expires) {
+				return false, nil
+			}
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[key] = formatLease(holder, now.Add(ttl))
+
+		if _, err := s.client.Update(cm); err != nil {
+			if k8serrors.IsConflict(err) {
+				continue
+			}
+			return false, err
+		}
+		return true, nil
+	}
+}
+
+func (s *configMapLeaseStore) Release(key, holder string) error {
+	for {
+		cm, err := s.getOrCreate()
+		if err != nil {
+			return err
+		}
+
+		raw, ok := cm.Data[key]
+		if !ok {
+			return nil
+		}
+		existingHolder, _, err := parseLease(raw)
+		if err != nil || existingHolder != holder {
+			return nil
+		}
+
+		delete(cm.Data, key)
+		if _, err := s.client.Update(cm); err != nil {
+			if k8serrors.IsConflict(err) {
+				continue
+			}
+			return err
+		}
+		return nil
+	}
+}
+
+// getOrCreate fetches the backing ConfigMap, creating it (with empty Data) if it does not yet
+// exist. It tolerates a concurrent creator winning the race.
+func (s *configMapLeaseStore) getOrCreate() (*corev1.ConfigMap, error) {
+	cm, err := s.client.Get(s.name)
+	if err == nil {
+		return cm, nil
+	}
+	if !k8serrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	created, err := s.client.Create(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: s.name}, Data: map[string]string{}})
+	if err != nil {
+		if k8serrors.IsAlreadyExists(err) {
+			return s.client.Get(s.name)
+		}
+		return nil, err
+	}
+	return created, nil
+}
+
+// formatLease and parseLease encode a lease as "<holder>,<expiresRFC3339Nano>" so it fits in a
+// single ConfigMap Data value.
+func formatLease(holder string, expires time.Time) string {
+	return holder + "," + expires.Format(time.RFC3339Nano)
+}
+
+func parseLease(raw string) (holder string, expires time.Time, err error) {
+	idx := strings.LastIndex(raw, ",")
+	if idx < 0 {
+		return "", time.Time{}, fmt.Errorf("malformed lease entry %q", raw)
+	}
+	holder = raw[:idx]
+	expires, err = time.Parse(time.RFC3339Nano, raw[idx+1:])
+	return holder, expires, err
+}
+
+// pruneExpiredLeases drops every expired lease from cm.Data except skip. A lease whose holder
+// crashed (or otherwise never called Release) would otherwise sit in the ConfigMap forever, so
+// this piggybacks garbage collection onto the Acquire calls that already read and rewrite the
+// whole map, keeping the backing object's size bounded by the number of live leases rather than
+// the number of dedup keys ever used.
+func pruneExpiredLeases(cm *corev1.ConfigMap, now time.Time, skip string) {
+	for k, raw := range cm.Data {
+		if k == skip {
+			continue
+		}
+		if _, expires, err := parseLease(raw); err == nil && now.After(expires) {
+			delete(cm.Data, k)
+		}
+	}
+}
+
+// Acquirer serializes access to a dedup key (see DedupKeyFn) across competing plutil consumers
+// so that only one of them drives a given ProwJob's abort at a time. It does not itself know how
+// to abort a job; callers are expected to Acquire before mutating a ProwJob and Release once
+// they are done with it (whether or not the abort completed).
+type Acquirer struct {
+	store  LeaseStore
+	holder string
+	ttl    time.Duration
+}
+
+// NewAcquirer creates an Acquirer backed by store. holder should uniquely identify this process
+// (e.g. "plank" or a hostname), and ttl bounds how long a lease is honored before another holder
+// is allowed to take over a stalled one.
+func NewAcquirer(store LeaseStore, holder string, ttl time.Duration) *Acquirer {
+	return &Acquirer{store: store, holder: holder, ttl: ttl}
+}
+
+// Acquire attempts to take the lease for key on behalf of this Acquirer's holder. It returns
+// false, without error, if some other holder currently owns a live lease for key.
+func (a *Acquirer) Acquire(key string) (bool, error) {
+	acquired, err := a.store.Acquire(key, a.holder, a.ttl)
+	if err != nil {
+		leaseAcquireTotal.WithLabelValues("error").Inc()
+		return false, err
+	}
+	if acquired {
+		leaseAcquireTotal.WithLabelValues("acquired").Inc()
+	} else {
+		leaseAcquireTotal.WithLabelValues("contended").Inc()
+	}
+	return acquired, nil
+}
+
+// Release drops this Acquirer's lease on key, if it holds one.
+func (a *Acquirer) Release(key string) error {
+	return a.store.Release(key, a.holder)
+}
@@ -0,0 +1,49 @@
+package pjutil
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(prowJobAbortsTotal)
+}
+
+var prowJobAbortsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "prowjob_aborts_total",
+	Help: "Count of ProwJobs forced into AbortedState, by abort reason.",
+}, []string{"reason"})
+
+// AbortReason explains why a ProwJob was aborted, so that downstream reporters (crier, GitHub
+// status, Slack) can surface more than a bare "Aborted". It is persisted both as the ProwJob's
+// Status.AbortReason and, for consumers that only watch annotations, as AbortReasonAnnotation.
+type AbortReason string
+
+const (
+	// ReasonUnknown is used for ProwJobs aborted before this field was introduced, and should be
+	// treated as the default when Status.AbortReason is empty.
+	ReasonUnknown AbortReason = ""
+	// ReasonSupersededByNewer means a newer run of the same dedup key made this one redundant.
+	ReasonSupersededByNewer AbortReason = "SupersededByNewer"
+	// ReasonManualCancel means a human or external tool explicitly requested the cancellation.
+	ReasonManualCancel AbortReason = "ManualCancel"
+	// ReasonBatchReplaced means a newer batch containing a different set of pulls replaced this
+	// one.
+	ReasonBatchReplaced AbortReason = "BatchReplaced"
+	// ReasonForcedAfterTimeout means the job did not reach a terminal state within
+	// ForceCancelInterval of a graceful cancel request, and was forcibly aborted.
+	ReasonForcedAfterTimeout AbortReason = "ForcedAfterTimeout"
+)
+
+// AbortReasonAnnotation mirrors Status.AbortReason onto the ProwJob so that components that
+// only watch annotations (rather than deserializing the full status) can still see why a job
+// was aborted.
+const AbortReasonAnnotation = "prow.k8s.io/abort-reason"
+
+// EffectiveAbortReason returns pj's abort reason, treating an empty value as ReasonUnknown. This
+// is the correct way to read the reason off of a ProwJob that may predate this field.
+func EffectiveAbortReason(reason AbortReason) AbortReason {
+	if reason == "" {
+		return ReasonUnknown
+	}
+	return reason
+}
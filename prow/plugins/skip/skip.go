@@ -0,0 +1,230 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package skip implements the /skip plugin, which lets a user tell prow that a failed or
+// pending optional context no longer needs to be retried.
+package skip
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/pluginhelp"
+	"k8s.io/test-infra/prow/plugins"
+	"k8s.io/test-infra/prow/scallywag"
+)
+
+const pluginName = "skip"
+
+var (
+	skipRe   = regexp.MustCompile(`(?mi)^/skip(?:\s+(.+?))?\s*$`)
+	unskipRe = regexp.MustCompile(`(?mi)^/skip-unskip(?:\s+(.+?))?\s*$`)
+)
+
+func init() {
+	plugins.RegisterGenericCommentHandler(pluginName, handleGenericComment, helpProvider)
+}
+
+func helpProvider(config *plugins.Configuration, _ []string) (*pluginhelp.PluginHelp, error) {
+	pluginHelp := &pluginhelp.PluginHelp{
+		Description: "The skip plugin marks a failed or pending optional context as skipped so that it no longer blocks merge, and can undo that with /skip-unskip.",
+	}
+	pluginHelp.AddCommand(pluginhelp.Command{
+		Usage:       "/skip [context...]",
+		Description: "Skip all failed/pending optional contexts, or only the ones named.",
+		Examples:    []string{"/skip", "/skip unit-tests e2e-tests"},
+		WhoCanUse:   "Anyone who can trigger tests can skip them.",
+	})
+	pluginHelp.AddCommand(pluginhelp.Command{
+		Usage:       "/skip-unskip context...",
+		Description: "Undo a previous /skip by re-running the named context(s).",
+		Examples:    []string{"/skip-unskip unit-tests"},
+		WhoCanUse:   "Anyone who can trigger tests can unskip them.",
+	})
+	return pluginHelp, nil
+}
+
+type githubClient interface {
+	CreateComment(org, repo string, number int, comment string) error
+	CreateStatus(org, repo, ref string, s scallywag.Status) error
+	GetCombinedStatus(org, repo, ref string) (*scallywag.CombinedStatus, error)
+	GetPullRequest(org, repo string, number int) (*scallywag.PullRequest, error)
+}
+
+func handleGenericComment(pc plugins.Agent, e scallywag.GenericCommentEvent) error {
+	presubmits := pc.Config.PresubmitsStatic[e.Repo.Owner.Login+"/"+e.Repo.Name]
+	return handle(pc.GitHubClient, pc.Logger, &e, presubmits, pc.PluginConfig.TriggerFor(e.Repo.Owner.Login, e.Repo.Name).ElideSkippedContexts)
+}
+
+// parseContexts extracts the (possibly empty) whitespace-separated list of contexts named on
+// the first line matched by re, e.g. "/skip foo bar" -> ["foo", "bar"], "/skip" -> nil.
+func parseContexts(re *regexp.Regexp, body string) (matched bool, contexts []string) {
+	match := re.FindStringSubmatch(body)
+	if match == nil {
+		return false, nil
+	}
+	if strings.TrimSpace(match[1]) == "" {
+		return true, nil
+	}
+	return true, strings.Fields(match[1])
+}
+
+// handle implements the /skip and /skip-unskip commands. presubmits is the full set of static
+// presubmits configured for the PR's repo; elideSkippedContexts additionally excludes from
+// skipping any context whose RerunCommand also appears in the comment body, so that a combined
+// "/skip\n/test foo" does not skip a context the user is explicitly re-running in the same
+// breath.
+func handle(gc githubClient, log *logrus.Entry, e *scallywag.GenericCommentEvent, presubmits []config.Presubmit, elideSkippedContexts bool) error {
+	if !e.IsPR || e.IssueState == "closed" || e.Action != scallywag.GenericCommentActionCreated {
+		return nil
+	}
+
+	skipMatched, skipContexts := parseContexts(skipRe, e.Body)
+	unskipMatched, unskipContexts := parseContexts(unskipRe, e.Body)
+	if !skipMatched && !unskipMatched {
+		return nil
+	}
+
+	optional := make(map[string]config.Presubmit, len(presubmits))
+	var validContexts []string
+	for _, presubmit := range presubmits {
+		if !presubmit.Optional {
+			continue
+		}
+		optional[presubmit.Reporter.Context] = presubmit
+		validContexts = append(validContexts, presubmit.Reporter.Context)
+	}
+	sort.Strings(validContexts)
+
+	var errs []error
+
+	if skipMatched {
+		if err := doSkip(gc, log, e, optional, validContexts, skipContexts, elideSkippedContexts); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if unskipMatched {
+		if err := doUnskip(gc, e, optional, validContexts, unskipContexts); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.NewAggregate(errs)
+}
+
+func doSkip(gc githubClient, log *logrus.Entry, e *scallywag.GenericCommentEvent, optional map[string]config.Presubmit, validContexts, requested []string, elideSkippedContexts bool) error {
+	org := e.Repo.Owner.Login
+	repo := e.Repo.Name
+
+	pr, err := gc.GetPullRequest(org, repo, e.Number)
+	if err != nil {
+		return err
+	}
+	combinedStatus, err := gc.GetCombinedStatus(org, repo, pr.Head.SHA)
+	if err != nil {
+		return err
+	}
+	statusesByContext := make(map[string]scallywag.Status, len(combinedStatus.Statuses))
+	for _, status := range combinedStatus.Statuses {
+		statusesByContext[status.Context] = status
+	}
+
+	var toSkip, unknown []string
+	if len(requested) == 0 {
+		for context := range optional {
+			toSkip = append(toSkip, context)
+		}
+	} else {
+		for _, context := range requested {
+			if _, ok := optional[context]; !ok {
+				unknown = append(unknown, context)
+				continue
+			}
+			toSkip = append(toSkip, context)
+		}
+	}
+	sort.Strings(toSkip)
+
+	if len(unknown) > 0 {
+		if err := rejectUnknownContexts(gc, org, repo, e.Number, "/skip", unknown, validContexts); err != nil {
+			log.WithError(err).Warn("could not comment about unrecognized /skip contexts")
+		}
+	}
+
+	var errs []error
+	for _, context := range toSkip {
+		presubmit := optional[context]
+		status, ok := statusesByContext[context]
+		if !ok {
+			continue
+		}
+		if status.State != scallywag.StatusFailure && status.State != scallywag.StatusPending {
+			continue
+		}
+		if elideSkippedContexts && presubmit.TriggerMatches(e.Body) {
+			continue
+		}
+
+		if err := gc.CreateStatus(org, repo, pr.Head.SHA, scallywag.Status{
+			State:       scallywag.StatusSuccess,
+			Description: "Skipped",
+			Context:     context,
+		}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.NewAggregate(errs)
+}
+
+func doUnskip(gc githubClient, e *scallywag.GenericCommentEvent, optional map[string]config.Presubmit, validContexts, requested []string) error {
+	org := e.Repo.Owner.Login
+	repo := e.Repo.Name
+
+	var rerunCommands, unknown []string
+	for _, context := range requested {
+		presubmit, ok := optional[context]
+		if !ok {
+			unknown = append(unknown, context)
+			continue
+		}
+		rerunCommands = append(rerunCommands, presubmit.RerunCommand)
+	}
+
+	if len(unknown) > 0 {
+		if err := rejectUnknownContexts(gc, org, repo, e.Number, "/skip-unskip", unknown, validContexts); err != nil {
+			return err
+		}
+	}
+	if len(rerunCommands) == 0 {
+		return nil
+	}
+
+	return gc.CreateComment(org, repo, e.Number, strings.Join(rerunCommands, "\n"))
+}
+
+func rejectUnknownContexts(gc githubClient, org, repo string, number int, command string, unknown, validContexts []string) error {
+	comment := fmt.Sprintf(
+		"%s does not recognize the following context(s): %s\n\nAvailable optional context(s): %s",
+		command, strings.Join(unknown, ", "), strings.Join(validContexts, ", "),
+	)
+	return gc.CreateComment(org, repo, number, comment)
+}
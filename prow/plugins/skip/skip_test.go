@@ -23,8 +23,8 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"k8s.io/test-infra/prow/config"
-	"k8s.io/test-infra/prow/scallywag/github/fakegithub"
 	"k8s.io/test-infra/prow/scallywag"
+	"k8s.io/test-infra/prow/scallywag/github/fakegithub"
 )
 
 func TestSkipStatus(t *testing.T) {
@@ -37,7 +37,8 @@ func TestSkipStatus(t *testing.T) {
 		prChanges  map[int][]scallywag.PullRequestChange
 		existing   []scallywag.Status
 
-		expected []scallywag.Status
+		expected        []scallywag.Status
+		expectedComment string
 	}{
 		{
 			name: "required contexts should not be skipped regardless of their state",
@@ -242,6 +243,128 @@ func TestSkipStatus(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "selective skip only affects the named contexts",
+
+			presubmits: []config.Presubmit{
+				{
+					Optional: true,
+					Reporter: config.Reporter{
+						Context: "failed-tests",
+					},
+				},
+				{
+					Optional: true,
+					Reporter: config.Reporter{
+						Context: "pending-tests",
+					},
+				},
+			},
+			sha: "shalala",
+			event: &scallywag.GenericCommentEvent{
+				IsPR:       true,
+				IssueState: "open",
+				Action:     scallywag.GenericCommentActionCreated,
+				Body:       "/skip failed-tests",
+				Number:     1,
+				Repo:       scallywag.Repo{Owner: scallywag.User{Login: "org"}, Name: "repo"},
+			},
+			existing: []scallywag.Status{
+				{
+					State:   scallywag.StatusFailure,
+					Context: "failed-tests",
+				},
+				{
+					State:   scallywag.StatusPending,
+					Context: "pending-tests",
+				},
+			},
+
+			expected: []scallywag.Status{
+				{
+					State:       scallywag.StatusSuccess,
+					Description: "Skipped",
+					Context:     "failed-tests",
+				},
+				{
+					State:   scallywag.StatusPending,
+					Context: "pending-tests",
+				},
+			},
+		},
+		{
+			name: "skip with an unknown context is rejected with a comment",
+
+			presubmits: []config.Presubmit{
+				{
+					Optional: true,
+					Reporter: config.Reporter{
+						Context: "failed-tests",
+					},
+				},
+			},
+			sha: "shalala",
+			event: &scallywag.GenericCommentEvent{
+				IsPR:       true,
+				IssueState: "open",
+				Action:     scallywag.GenericCommentActionCreated,
+				Body:       "/skip made-up-tests",
+				Number:     1,
+				Repo:       scallywag.Repo{Owner: scallywag.User{Login: "org"}, Name: "repo"},
+			},
+			existing: []scallywag.Status{
+				{
+					State:   scallywag.StatusFailure,
+					Context: "failed-tests",
+				},
+			},
+
+			expected: []scallywag.Status{
+				{
+					State:   scallywag.StatusFailure,
+					Context: "failed-tests",
+				},
+			},
+			expectedComment: "/skip does not recognize the following context(s): made-up-tests\n\nAvailable optional context(s): failed-tests",
+		},
+		{
+			name: "skip-unskip re-triggers the named context via its rerun command",
+
+			presubmits: []config.Presubmit{
+				{
+					Optional:     true,
+					RerunCommand: "/test failed-tests",
+					Reporter: config.Reporter{
+						Context: "failed-tests",
+					},
+				},
+			},
+			sha: "shalala",
+			event: &scallywag.GenericCommentEvent{
+				IsPR:       true,
+				IssueState: "open",
+				Action:     scallywag.GenericCommentActionCreated,
+				Body:       "/skip-unskip failed-tests",
+				Number:     1,
+				Repo:       scallywag.Repo{Owner: scallywag.User{Login: "org"}, Name: "repo"},
+			},
+			existing: []scallywag.Status{
+				{
+					State:       scallywag.StatusSuccess,
+					Description: "Skipped",
+					Context:     "failed-tests",
+				},
+			},
+
+			expected: []scallywag.Status{
+				{
+					State:       scallywag.StatusSuccess,
+					Description: "Skipped",
+					Context:     "failed-tests",
+				},
+			},
+			expectedComment: "/test failed-tests",
+		},
 	}
 
 	for _, test := range tests {
@@ -291,5 +414,16 @@ func TestSkipStatus(t *testing.T) {
 				break
 			}
 		}
+
+		if test.expectedComment != "" {
+			comments := fghc.IssueComments[test.event.Number]
+			if len(comments) != 1 {
+				t.Errorf("%s: expected exactly one comment, got: %+v", test.name, comments)
+				continue
+			}
+			if comments[0].Body != test.expectedComment {
+				t.Errorf("%s: expected comment:\n%s\ngot:\n%s", test.name, test.expectedComment, comments[0].Body)
+			}
+		}
 	}
 }
@@ -0,0 +1,286 @@
+package prowjobgen
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+
+	"sigs.k8s.io/yaml"
+
+	"k8s.io/test-infra/prow/config"
+)
+
+// Generator renders the presubmit/postsubmit jobs described by a RepoSpec using the job
+// templates found in TemplatesDir.
+type Generator struct {
+	templates *template.Template
+}
+
+// NewGenerator loads every template under templatesDir so that job templates can reference one
+// another (e.g. a shared header partial).
+func NewGenerator(templatesDir string) (*Generator, error) {
+	tmpl, err := template.New("").Funcs(funcMap()).ParseGlob(filepath.Join(templatesDir, "*"))
+	if err != nil {
+		return nil, fmt.Errorf("loading templates from %s: %w", templatesDir, err)
+	}
+	return &Generator{templates: tmpl}, nil
+}
+
+// renderData is the value passed to a job template.
+type renderData struct {
+	Org    string
+	Repo   string
+	Branch string
+	Name   string
+	Vars   map[string]string
+}
+
+// Generate renders every job in spec for every branch matched by a branch binding, returning the
+// presubmits and postsubmits in a deterministic (name, branch) order.
+func (g *Generator) Generate(spec RepoSpec) ([]config.Presubmit, []config.Postsubmit, error) {
+	var presubmits []config.Presubmit
+	var postsubmits []config.Postsubmit
+
+	for _, binding := range spec.Branches {
+		branches, err := expandBranches(binding, spec.KnownBranches)
+		if err != nil {
+			return nil, nil, fmt.Errorf("expanding branch binding %q for %s/%s: %w", binding.Name, spec.Org, spec.Repo, err)
+		}
+
+		for _, branch := range branches {
+			for _, jt := range spec.Jobs {
+				raw, err := g.render(jt, spec.Org, spec.Repo, branch)
+				if err != nil {
+					return nil, nil, fmt.Errorf("rendering job %q for %s/%s@%s: %w", jt.Name, spec.Org, spec.Repo, branch, err)
+				}
+
+				switch jt.Type {
+				case "presubmit":
+					var p config.Presubmit
+					if err := yaml.Unmarshal(raw, &p); err != nil {
+						return nil, nil, fmt.Errorf("unmarshaling presubmit %q: %w", jt.Name, err)
+					}
+					presubmits = append(presubmits, p)
+				case "postsubmit":
+					var p config.Postsubmit
+					if err := yaml.Unmarshal(raw, &p); err != nil {
+						return nil, nil, fmt.Errorf("unmarshaling postsubmit %q: %w", jt.Name, err)
+					}
+					postsubmits = append(postsubmits, p)
+				default:
+					return nil, nil, fmt.Errorf("job %q: unknown type %q, want \"presubmit\" or \"postsubmit\"", jt.Name, jt.Type)
+				}
+			}
+		}
+	}
+
+	sort.Slice(presubmits, func(i, j int) bool { return presubmits[i].Name < presubmits[j].Name })
+	sort.Slice(postsubmits, func(i, j int) bool { return postsubmits[i].Name < postsubmits[j].Name })
+
+	return presubmits, postsubmits, nil
+}
+
+// isBranchGlob reports whether name contains glob metacharacters that path.Match understands.
+func isBranchGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// expandBranches resolves a single BranchBinding to the concrete branches it applies to. A
+// literal (non-glob) Name is used as-is, with no knownBranches required. A glob Name is matched
+// against knownBranches and, if SemverRange is set, further filtered to only the matching
+// branches whose trailing version satisfies it - so "release-*" plus a range like ">=1.25"
+// expands to exactly the supported release branches without the spec author having to enumerate
+// them by hand.
+func expandBranches(binding BranchBinding, knownBranches []string) ([]string, error) {
+	if !isBranchGlob(binding.Name) {
+		return []string{binding.Name}, nil
+	}
+
+	var matched []string
+	for _, branch := range knownBranches {
+		ok, err := branchMatches(binding.Name, branch)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		if binding.SemverRange != "" {
+			version, ok := branchVersion(branch)
+			if !ok {
+				continue
+			}
+			satisfies, err := semverCompare(binding.SemverRange, version)
+			if err != nil {
+				return nil, err
+			}
+			if !satisfies {
+				continue
+			}
+		}
+
+		matched = append(matched, branch)
+	}
+
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("glob pattern %q matched no branch in knownBranches (semverRange %q)", binding.Name, binding.SemverRange)
+	}
+
+	sort.Strings(matched)
+	return matched, nil
+}
+
+// render executes the job template named by jt.Template against the given branch.
+func (g *Generator) render(jt JobTemplate, org, repo, branch string) ([]byte, error) {
+	var buf bytes.Buffer
+	data := renderData{Org: org, Repo: repo, Branch: branch, Name: jt.Name, Vars: jt.Vars}
+	if err := g.templates.ExecuteTemplate(&buf, jt.Template, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jobConfig mirrors the subset of prow/config's on-disk job config format that this generator
+// owns: a single org/repo's presubmits and postsubmits.
+type jobConfig struct {
+	Presubmits  map[string][]config.Presubmit  `json:"presubmits,omitempty"`
+	Postsubmits map[string][]config.Postsubmit `json:"postsubmits,omitempty"`
+}
+
+// Marshal renders the generated jobs for org/repo into the on-disk YAML shape consumed by the
+// prow/config loader.
+func Marshal(org, repo string, presubmits []config.Presubmit, postsubmits []config.Postsubmit) ([]byte, error) {
+	key := org + "/" + repo
+	jc := jobConfig{}
+	if len(presubmits) > 0 {
+		jc.Presubmits = map[string][]config.Presubmit{key: presubmits}
+	}
+	if len(postsubmits) > 0 {
+		jc.Postsubmits = map[string][]config.Postsubmit{key: postsubmits}
+	}
+	return yaml.Marshal(jc)
+}
+
+// ParseJobConfig parses raw job config YAML in the shape written by Marshal, without applying
+// any of the prow/config loader's defaulting (compiled Brancher regexes, default cluster and
+// decoration settings, and so on). Callers that want to diff a checked-in job config against
+// freshly generated jobs should parse the existing file with this, not load it through
+// prow/config, since a freshly generated job never carries that defaulting either - comparing a
+// defaulted struct against an undefaulted one would report every job as different.
+func ParseJobConfig(raw []byte) (presubmits map[string][]config.Presubmit, postsubmits map[string][]config.Postsubmit, err error) {
+	var jc jobConfig
+	if err := yaml.Unmarshal(raw, &jc); err != nil {
+		return nil, nil, err
+	}
+	return jc.Presubmits, jc.Postsubmits, nil
+}
+
+// DiffJobs reports whether the generated presubmits/postsubmits for an org/repo are already
+// reflected in existingPre/existingPost - typically the same org/repo's entries from a file
+// parsed with ParseJobConfig. Comparing the parsed structs instead of marshaled YAML means a
+// hand-applied comment or reordering of the on-disk file doesn't cause a spurious --check
+// failure; only an actual difference in job content does.
+func DiffJobs(generatedPre, existingPre []config.Presubmit, generatedPost, existingPost []config.Postsubmit) (diff string, equal bool) {
+	var b strings.Builder
+	preEqual := diffPresubmits(&b, generatedPre, existingPre)
+	postEqual := diffPostsubmits(&b, generatedPost, existingPost)
+	return b.String(), preEqual && postEqual
+}
+
+func diffPresubmits(b *strings.Builder, generated, existing []config.Presubmit) bool {
+	gen := make(map[string]config.Presubmit, len(generated))
+	for _, p := range generated {
+		gen[p.Name] = p
+	}
+	cur := make(map[string]config.Presubmit, len(existing))
+	for _, p := range existing {
+		cur[p.Name] = p
+	}
+
+	equal := true
+	for name, g := range gen {
+		if e, ok := cur[name]; !ok {
+			fmt.Fprintf(b, "presubmit %q is missing from the existing config\n", name)
+			equal = false
+		} else if !reflect.DeepEqual(g, e) {
+			fmt.Fprintf(b, "presubmit %q differs from the existing config\n", name)
+			equal = false
+		}
+	}
+	for name := range cur {
+		if _, ok := gen[name]; !ok {
+			fmt.Fprintf(b, "presubmit %q no longer has a generator source\n", name)
+			equal = false
+		}
+	}
+	return equal
+}
+
+func diffPostsubmits(b *strings.Builder, generated, existing []config.Postsubmit) bool {
+	gen := make(map[string]config.Postsubmit, len(generated))
+	for _, p := range generated {
+		gen[p.Name] = p
+	}
+	cur := make(map[string]config.Postsubmit, len(existing))
+	for _, p := range existing {
+		cur[p.Name] = p
+	}
+
+	equal := true
+	for name, g := range gen {
+		if e, ok := cur[name]; !ok {
+			fmt.Fprintf(b, "postsubmit %q is missing from the existing config\n", name)
+			equal = false
+		} else if !reflect.DeepEqual(g, e) {
+			fmt.Fprintf(b, "postsubmit %q differs from the existing config\n", name)
+			equal = false
+		}
+	}
+	for name := range cur {
+		if _, ok := gen[name]; !ok {
+			fmt.Fprintf(b, "postsubmit %q no longer has a generator source\n", name)
+			equal = false
+		}
+	}
+	return equal
+}
+
+// Diff reports whether generated and existing are byte-identical and, if not, a human-readable
+// summary of the first differing lines suitable for a --check failure message. It is used only
+// for comparing freshly generated YAML against a golden fixture in tests; cmd/prowjob-generator
+// uses DiffJobs, which compares parsed job structs loaded via prow/config instead.
+func Diff(generated, existing []byte) (diff string, equal bool) {
+	if bytes.Equal(generated, existing) {
+		return "", true
+	}
+
+	genLines := strings.Split(string(generated), "\n")
+	existingLines := strings.Split(string(existing), "\n")
+
+	var b strings.Builder
+	max := len(genLines)
+	if len(existingLines) > max {
+		max = len(existingLines)
+	}
+	shown := 0
+	for i := 0; i < max && shown < 10; i++ {
+		var g, e string
+		if i < len(genLines) {
+			g = genLines[i]
+		}
+		if i < len(existingLines) {
+			e = existingLines[i]
+		}
+		if g == e {
+			continue
+		}
+		fmt.Fprintf(&b, "line %d:\n- %s\n+ %s\n", i+1, e, g)
+		shown++
+	}
+	return b.String(), false
+}
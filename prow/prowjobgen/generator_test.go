@@ -0,0 +1,158 @@
+package prowjobgen
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestGenerateGolden(t *testing.T) {
+	gen, err := NewGenerator(filepath.Join("testdata", "templates"))
+	if err != nil {
+		t.Fatalf("failed to load templates: %v", err)
+	}
+
+	specRaw, err := ioutil.ReadFile(filepath.Join("testdata", "specs", "example.yaml"))
+	if err != nil {
+		t.Fatalf("failed to read spec: %v", err)
+	}
+	var spec RepoSpec
+	if err := yaml.Unmarshal(specRaw, &spec); err != nil {
+		t.Fatalf("failed to unmarshal spec: %v", err)
+	}
+
+	presubmits, postsubmits, err := gen.Generate(spec)
+	if err != nil {
+		t.Fatalf("failed to generate jobs: %v", err)
+	}
+
+	got, err := Marshal(spec.Org, spec.Repo, presubmits, postsubmits)
+	if err != nil {
+		t.Fatalf("failed to marshal generated jobs: %v", err)
+	}
+
+	want, err := ioutil.ReadFile(filepath.Join("testdata", "golden", "example.yaml"))
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+
+	diff, equal := Diff(got, want)
+	if !equal {
+		t.Errorf("generated jobs do not match golden file:\n%s", diff)
+	}
+}
+
+func TestGenerateUnknownJobType(t *testing.T) {
+	gen, err := NewGenerator(filepath.Join("testdata", "templates"))
+	if err != nil {
+		t.Fatalf("failed to load templates: %v", err)
+	}
+
+	spec := RepoSpec{
+		Org:      "example-org",
+		Repo:     "example-repo",
+		Branches: []BranchBinding{{Name: "main"}},
+		Jobs:     []JobTemplate{{Name: "unit", Type: "periodic", Template: "presubmit.yaml.tmpl"}},
+	}
+
+	if _, _, err := gen.Generate(spec); err == nil {
+		t.Fatal("expected an error for an unknown job type, got nil")
+	}
+}
+
+func TestExpandBranches(t *testing.T) {
+	known := []string{"main", "release-1.23", "release-1.24", "release-1.25", "release-1.26", "experimental"}
+
+	tests := []struct {
+		name    string
+		binding BranchBinding
+		want    []string
+	}{
+		{
+			name:    "literal name is used as-is, even if absent from knownBranches",
+			binding: BranchBinding{Name: "main"},
+			want:    []string{"main"},
+		},
+		{
+			name:    "glob with no semver range matches every known branch",
+			binding: BranchBinding{Name: "release-*"},
+			want:    []string{"release-1.23", "release-1.24", "release-1.25", "release-1.26"},
+		},
+		{
+			name:    "glob with a semver range only matches satisfying branches",
+			binding: BranchBinding{Name: "release-*", SemverRange: ">=1.25"},
+			want:    []string{"release-1.25", "release-1.26"},
+		},
+		{
+			name:    "semver range excludes branches that don't follow the release-X.Y convention",
+			binding: BranchBinding{Name: "*", SemverRange: ">=1.0"},
+			want:    []string{"release-1.23", "release-1.24", "release-1.25", "release-1.26"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := expandBranches(test.binding, known)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestExpandBranchesErrorsOnNoMatch(t *testing.T) {
+	_, err := expandBranches(BranchBinding{Name: "release-*", SemverRange: ">=9.9"}, []string{"main", "release-1.25"})
+	if err == nil {
+		t.Fatal("expected an error when a glob binding matches no known branch, got nil")
+	}
+}
+
+func TestDiffJobsAgainstParsedJobConfig(t *testing.T) {
+	gen, err := NewGenerator(filepath.Join("testdata", "templates"))
+	if err != nil {
+		t.Fatalf("failed to load templates: %v", err)
+	}
+
+	specRaw, err := ioutil.ReadFile(filepath.Join("testdata", "specs", "example.yaml"))
+	if err != nil {
+		t.Fatalf("failed to read spec: %v", err)
+	}
+	var spec RepoSpec
+	if err := yaml.Unmarshal(specRaw, &spec); err != nil {
+		t.Fatalf("failed to unmarshal spec: %v", err)
+	}
+
+	presubmits, postsubmits, err := gen.Generate(spec)
+	if err != nil {
+		t.Fatalf("failed to generate jobs: %v", err)
+	}
+
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "golden", "example.yaml"))
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	existingPre, existingPost, err := ParseJobConfig(golden)
+	if err != nil {
+		t.Fatalf("failed to parse golden file: %v", err)
+	}
+
+	key := spec.Org + "/" + spec.Repo
+	if diff, equal := DiffJobs(presubmits, existingPre[key], postsubmits, existingPost[key]); !equal {
+		t.Errorf("expected freshly generated jobs to match the identically-parsed golden file:\n%s", diff)
+	}
+}
+
+func TestDiffDetectsMismatch(t *testing.T) {
+	if _, equal := Diff([]byte("a\nb\n"), []byte("a\nc\n")); equal {
+		t.Fatal("expected Diff to report a mismatch")
+	}
+	if _, equal := Diff([]byte("a\nb\n"), []byte("a\nb\n")); !equal {
+		t.Fatal("expected Diff to report identical content as equal")
+	}
+}
@@ -0,0 +1,63 @@
+package prowjobgen
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/semver"
+)
+
+// funcMap returns the sprig-style helpers available to job templates: semver comparison,
+// branch-pattern matching, and a "default" helper for optional variables.
+func funcMap() template.FuncMap {
+	return template.FuncMap{
+		"semverCompare": semverCompare,
+		"branchMatches": branchMatches,
+		"default":       defaultValue,
+	}
+}
+
+// semverCompare reports whether version satisfies the given semver constraint range, e.g.
+// semverCompare(">=1.20", "1.22.3") == true. Both "v"-prefixed and bare versions are accepted.
+func semverCompare(constraint, version string) (bool, error) {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return false, err
+	}
+	v, err := semver.NewVersion(strings.TrimPrefix(version, "v"))
+	if err != nil {
+		return false, err
+	}
+	return c.Check(v), nil
+}
+
+// branchMatches reports whether branch satisfies pattern, where pattern is either an exact
+// branch name or a glob such as "release-*".
+func branchMatches(pattern, branch string) (bool, error) {
+	return path.Match(pattern, branch)
+}
+
+// defaultValue returns def if value is empty, and value otherwise.
+func defaultValue(def, value string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// branchVersionRe extracts the version suffix from the release-branch naming convention used to
+// gate BranchBinding.SemverRange, e.g. "release-1.25" -> "1.25".
+var branchVersionRe = regexp.MustCompile(`^release-(\d+\.\d+(?:\.\d+)?)$`)
+
+// branchVersion extracts the version suffix from a release branch name, e.g. "release-1.25" ->
+// ("1.25", true). It returns ok=false for branches that don't follow the release-X.Y(.Z)
+// convention, since those can't be meaningfully compared against a SemverRange.
+func branchVersion(branch string) (string, bool) {
+	m := branchVersionRe.FindStringSubmatch(branch)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
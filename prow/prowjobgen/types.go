@@ -0,0 +1,43 @@
+// Package prowjobgen renders the presubmit/postsubmit YAML consumed by prow/config from a
+// compact per-repo spec plus Go text/template templates, so that adding a release branch or
+// bumping a Kubernetes version becomes a one-line change that regenerates every affected job.
+package prowjobgen
+
+// RepoSpec describes the jobs that should exist for a single org/repo and the branches they
+// apply to. A directory of RepoSpecs, one per repo, is the input to the generator.
+type RepoSpec struct {
+	Org      string          `json:"org" yaml:"org"`
+	Repo     string          `json:"repo" yaml:"repo"`
+	Branches []BranchBinding `json:"branches" yaml:"branches"`
+	Jobs     []JobTemplate   `json:"jobs" yaml:"jobs"`
+	// KnownBranches is the candidate set that glob BranchBindings (e.g. "release-*") are
+	// expanded against. It is typically kept up to date by a separate process that mirrors the
+	// repo's real branch list; literal, non-glob BranchBindings don't need an entry here.
+	KnownBranches []string `json:"knownBranches,omitempty" yaml:"knownBranches,omitempty"`
+}
+
+// BranchBinding describes a branch, or a pattern of branches (e.g. "release-*"), that jobs can
+// be generated against. A Name containing no glob metacharacters is used as-is. A glob Name is
+// expanded against RepoSpec.KnownBranches, and, if SemverRange is also set, further restricted to
+// the matching branches whose trailing version satisfies the range - see expandBranches.
+type BranchBinding struct {
+	Name        string `json:"name" yaml:"name"`
+	SemverRange string `json:"semverRange,omitempty" yaml:"semverRange,omitempty"`
+}
+
+// JobTemplate names a text/template file (relative to the generator's templates directory) and
+// the variables it should be rendered with. The same template is rendered once per matching
+// BranchBinding, so Vars may reference "{{.Branch}}" and similar bindings supplied at render
+// time in addition to the ones listed here.
+type JobTemplate struct {
+	// Name is the job's base name; the rendered job name is derived from it and the branch it
+	// was generated for.
+	Name string `json:"name" yaml:"name"`
+	// Type is either "presubmit" or "postsubmit".
+	Type string `json:"type" yaml:"type"`
+	// Template is the path, relative to the templates directory, of the text/template file to
+	// render for this job.
+	Template string `json:"template" yaml:"template"`
+	// Vars are passed to the template as .Vars.
+	Vars map[string]string `json:"vars,omitempty" yaml:"vars,omitempty"`
+}